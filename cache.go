@@ -0,0 +1,198 @@
+package iap
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/xerrors"
+)
+
+// defaultCacheSkew is subtracted from a cached token's expiry when deciding
+// whether it is still usable, so that a token isn't handed out moments
+// before it expires.
+const defaultCacheSkew = 2 * time.Minute
+
+// TokenCache persists tokens across process invocations, so that CLI tools
+// built on this package don't have to mint a fresh token on every
+// invocation.
+type TokenCache interface {
+	// Get returns the cached token for key, or a nil token if nothing is
+	// cached. It is not an error for key to be absent.
+	Get(key string) (*oauth2.Token, error)
+	Put(key string, tok *oauth2.Token) error
+}
+
+// WithTokenCache causes New to consult cache before minting a new token,
+// and to populate it on every refresh.
+func WithTokenCache(cache TokenCache) Option {
+	return func(o *options) error {
+		o.tokenCache = cache
+		return nil
+	}
+}
+
+// WithCacheSkew overrides how long before a cached token's actual expiry it
+// is treated as expired. It has no effect unless WithTokenCache is also
+// used. The default is defaultCacheSkew.
+func WithCacheSkew(skew time.Duration) Option {
+	return func(o *options) error {
+		o.cacheSkew = skew
+		return nil
+	}
+}
+
+// cachedTokenSource consults cache before calling base, and writes back any
+// token obtained from base so that later processes can reuse it.
+type cachedTokenSource struct {
+	cache TokenCache
+	key   string
+	base  oauth2.TokenSource
+	skew  time.Duration
+}
+
+func (c *cachedTokenSource) Token() (*oauth2.Token, error) {
+	if tok, err := c.cache.Get(c.key); err == nil && c.usable(tok) {
+		return tok, nil
+	}
+
+	tok, err := c.base.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	// Caching is a best-effort optimization; a failure to persist
+	// shouldn't fail the caller, who already has a good token.
+	_ = c.cache.Put(c.key, tok)
+
+	return tok, nil
+}
+
+// forceRefreshToken bypasses the persistent cache and mints a new token
+// from base, writing the result back so later calls see it too.
+func (c *cachedTokenSource) forceRefreshToken() (*oauth2.Token, error) {
+	tok, err := forceRefreshTokenSource(c.base)
+	if err != nil {
+		return nil, err
+	}
+
+	_ = c.cache.Put(c.key, tok)
+
+	return tok, nil
+}
+
+func (c *cachedTokenSource) usable(tok *oauth2.Token) bool {
+	if tok == nil || tok.AccessToken == "" {
+		return false
+	}
+	if tok.Expiry.IsZero() {
+		return true
+	}
+	return time.Now().Before(tok.Expiry.Add(-c.skew))
+}
+
+// computeCacheKey derives a stable cache key from the audience and the
+// principal minting the token, mirroring how the broader Google auth
+// ecosystem keys cached impersonated and federated tokens: a SHA-256 digest
+// of the audience, the client_email (or closest equivalent) and the
+// credentials source type, so that distinct principals or credentials
+// never collide in a shared cache directory.
+func computeCacheKey(o *options, audience string) string {
+	principal, sourceType := cachePrincipal(o)
+
+	h := sha256.New()
+	_, _ = h.Write([]byte(audience))
+	_, _ = h.Write([]byte(principal))
+	_, _ = h.Write([]byte(sourceType))
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func cachePrincipal(o *options) (principal, sourceType string) {
+	if o.impersonation != nil {
+		return o.impersonation.targetServiceAccount, "impersonated_service_account"
+	}
+
+	data, err := resolveCredentialsJSON(o)
+	if err != nil || data == nil {
+		return "", "metadata"
+	}
+
+	var t credentialsType
+	if err := json.Unmarshal(data, &t); err != nil {
+		return "", "metadata"
+	}
+
+	switch t.Type {
+	case "service_account":
+		var key serviceAccountKey
+		_ = json.Unmarshal(data, &key)
+		return key.ClientEmail, t.Type
+	case "external_account":
+		var key externalAccountKey
+		_ = json.Unmarshal(data, &key)
+		return key.ServiceAccountImpersonationURL, t.Type
+	case "impersonated_service_account":
+		var key impersonatedServiceAccountKey
+		_ = json.Unmarshal(data, &key)
+		return key.ServiceAccountImpersonationURL, t.Type
+	default:
+		return "", t.Type
+	}
+}
+
+// fileTokenCache is the default TokenCache, storing one file per key under
+// a cache directory rooted at $XDG_CACHE_HOME (or ~/.cache).
+type fileTokenCache struct {
+	dir string
+}
+
+// NewFileTokenCache returns a TokenCache backed by files under
+// $XDG_CACHE_HOME/iap-token-source/ (or ~/.cache/iap-token-source/ if
+// XDG_CACHE_HOME is unset), with 0600 permissions.
+func NewFileTokenCache() TokenCache {
+	return &fileTokenCache{dir: defaultCacheDir()}
+}
+
+func defaultCacheDir() string {
+	base := os.Getenv("XDG_CACHE_HOME")
+	if base == "" {
+		base = filepath.Join(os.Getenv("HOME"), ".cache")
+	}
+	return filepath.Join(base, "iap-token-source")
+}
+
+func (f *fileTokenCache) Get(key string) (*oauth2.Token, error) {
+	data, err := ioutil.ReadFile(filepath.Join(f.dir, key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var tok oauth2.Token
+	if err := json.Unmarshal(data, &tok); err != nil {
+		return nil, xerrors.Errorf("failed to parse cached token: %w", err)
+	}
+
+	return &tok, nil
+}
+
+func (f *fileTokenCache) Put(key string, tok *oauth2.Token) error {
+	if err := os.MkdirAll(f.dir, 0700); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(tok)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(f.dir, key), data, 0600)
+}
@@ -0,0 +1,90 @@
+package iap
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+type memoryTokenCache struct {
+	tokens map[string]*oauth2.Token
+	puts   int
+}
+
+func (m *memoryTokenCache) Get(key string) (*oauth2.Token, error) {
+	return m.tokens[key], nil
+}
+
+func (m *memoryTokenCache) Put(key string, tok *oauth2.Token) error {
+	m.puts++
+	m.tokens[key] = tok
+	return nil
+}
+
+type counterTokenSource struct {
+	calls int
+	tok   oauth2.Token
+}
+
+func (c *counterTokenSource) Token() (*oauth2.Token, error) {
+	c.calls++
+	tok := c.tok
+	return &tok, nil
+}
+
+func TestCachedTokenSourceReusesValidToken(t *testing.T) {
+	cache := &memoryTokenCache{tokens: map[string]*oauth2.Token{}}
+	base := &counterTokenSource{tok: oauth2.Token{AccessToken: "tok", Expiry: time.Now().Add(time.Hour)}}
+
+	s := &cachedTokenSource{cache: cache, key: "k", base: base, skew: defaultCacheSkew}
+
+	for i := 0; i < 3; i++ {
+		tok, err := s.Token()
+		require.NoError(t, err)
+		require.Equal(t, "tok", tok.AccessToken)
+	}
+
+	require.Equal(t, 1, base.calls)
+	require.Equal(t, 1, cache.puts)
+}
+
+func TestCachedTokenSourceRefreshesExpiredToken(t *testing.T) {
+	cache := &memoryTokenCache{tokens: map[string]*oauth2.Token{
+		"k": {AccessToken: "stale", Expiry: time.Now().Add(time.Minute)},
+	}}
+	base := &counterTokenSource{tok: oauth2.Token{AccessToken: "fresh", Expiry: time.Now().Add(time.Hour)}}
+
+	s := &cachedTokenSource{cache: cache, key: "k", base: base, skew: defaultCacheSkew}
+
+	tok, err := s.Token()
+	require.NoError(t, err)
+	require.Equal(t, "fresh", tok.AccessToken)
+	require.Equal(t, 1, base.calls)
+}
+
+func TestCachedTokenSourceForceRefreshBypassesCache(t *testing.T) {
+	cache := &memoryTokenCache{tokens: map[string]*oauth2.Token{
+		"k": {AccessToken: "stale", Expiry: time.Now().Add(time.Hour)},
+	}}
+	base := &counterTokenSource{tok: oauth2.Token{AccessToken: "fresh", Expiry: time.Now().Add(time.Hour)}}
+
+	s := &cachedTokenSource{cache: cache, key: "k", base: base, skew: defaultCacheSkew}
+
+	tok, err := s.forceRefreshToken()
+	require.NoError(t, err)
+	require.Equal(t, "fresh", tok.AccessToken)
+	require.Equal(t, 1, base.calls)
+	require.Equal(t, "fresh", cache.tokens["k"].AccessToken)
+}
+
+func TestComputeCacheKeyStableForSamePrincipal(t *testing.T) {
+	data := testServiceAccountJSON(t, "https://example.com/token")
+
+	o1 := &options{credentialsJSON: data}
+	o2 := &options{credentialsJSON: data}
+
+	require.Equal(t, computeCacheKey(o1, "aud"), computeCacheKey(o2, "aud"))
+	require.NotEqual(t, computeCacheKey(o1, "aud"), computeCacheKey(o1, "other-aud"))
+}
@@ -10,7 +10,7 @@ import (
 
 func ExampleNew() {
 	audience := os.Getenv("AUDIENCE")
-	t, err := New(context.Background(), audience, "")
+	t, err := New(audience)
 	if err != nil {
 		log.Fatalf("failed to create token source: %v", err)
 	}
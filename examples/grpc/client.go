@@ -30,7 +30,6 @@ import (
 	iap "github.com/bakins/iap-token-source"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
-	"google.golang.org/grpc/credentials/oauth"
 	pb "google.golang.org/grpc/examples/helloworld/helloworld"
 )
 
@@ -44,7 +43,7 @@ func main() {
 	audience := os.Args[1]
 	address := os.Args[2]
 
-	iap, err := iap.New(context.Background(), audience, "")
+	ts, err := iap.New(audience)
 	if err != nil {
 		log.Fatalf("failed to create IAP token source: %v", err)
 	}
@@ -57,7 +56,7 @@ func main() {
 	options := []grpc.DialOption{
 		grpc.WithTransportCredentials(t),
 		// add an authorization token from the IAP token source to every gRPC client call
-		grpc.WithDefaultCallOptions(grpc.PerRPCCredentials(oauth.TokenSource{TokenSource: iap})),
+		grpc.WithDefaultCallOptions(grpc.PerRPCCredentials(iap.NewPerRPCCredentials(ts, true))),
 	}
 
 	conn, err := grpc.Dial(address, options...)
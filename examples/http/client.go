@@ -19,26 +19,16 @@ func main() {
 	audience := os.Args[1]
 	url := os.Args[2]
 
-	iap, err := iap.New(audience)
+	ts, err := iap.New(audience, iap.WithTokenCache(iap.NewFileTokenCache()))
 	if err != nil {
 		log.Fatalf("failed to create IAP token source: %v", err)
 	}
 
-	// this example shows getting and using the token manually.
-	// You could also use a client created using https://godoc.org/golang.org/x/oauth2#NewClient
-	req, err := http.NewRequest(http.MethodGet, url, nil)
-	if err != nil {
-		log.Fatalf("NewRequest failed: %v", err)
+	client := &http.Client{
+		Transport: iap.NewTransport(nil, ts),
 	}
 
-	token, err := iap.Token()
-	if err != nil {
-		log.Fatalf("failed to get token: %v", err)
-	}
-
-	req.Header.Set("Authorization", token.TokenType+" "+token.AccessToken)
-
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := client.Get(url)
 	if err != nil {
 		log.Fatalf("HTTP request failed: %v", err)
 	}
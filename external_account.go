@@ -0,0 +1,767 @@
+package iap
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+	"golang.org/x/xerrors"
+)
+
+// externalAccountKey is the subset of a Workload Identity Federation
+// credentials file (as produced by `gcloud iam workload-identity-pools
+// create-cred-config`) that is needed to exchange a third party subject
+// token for a Google access token, and then an IAP identity token.
+type externalAccountKey struct {
+	Type                           string                    `json:"type"`
+	Audience                       string                    `json:"audience"`
+	SubjectTokenType               string                    `json:"subject_token_type"`
+	TokenURL                       string                    `json:"token_url"`
+	ServiceAccountImpersonationURL string                    `json:"service_account_impersonation_url"`
+	TokenInfoURL                   string                    `json:"token_info_url"`
+	CredentialSource               externalAccountCredSource `json:"credential_source"`
+}
+
+// subjectTokenFormat describes how to extract the subject token from a
+// file or URL based credential_source response body.
+type subjectTokenFormat struct {
+	Type                  string `json:"type"`
+	SubjectTokenFieldName string `json:"subject_token_field_name"`
+}
+
+type externalAccountCredSource struct {
+	File                        string                           `json:"file"`
+	URL                         string                           `json:"url"`
+	Format                      subjectTokenFormat               `json:"format"`
+	Headers                     map[string]string                `json:"headers"`
+	Executable                  *externalAccountExecutableSource `json:"executable"`
+	EnvironmentID               string                           `json:"environment_id"`
+	RegionURL                   string                           `json:"region_url"`
+	RegionalCredVerificationURL string                           `json:"regional_cred_verification_url"`
+}
+
+type externalAccountExecutableSource struct {
+	Command       string `json:"command"`
+	TimeoutMillis int    `json:"timeout_millis"`
+	OutputFile    string `json:"output_file"`
+}
+
+// subjectTokenRetriever obtains the third party subject token that is
+// exchanged with the STS token_url for a federated Google access token.
+type subjectTokenRetriever interface {
+	subjectToken(audience string) (string, error)
+}
+
+// httpDoer is implemented by PostFormer test doubles that also want to
+// intercept plain *http.Request calls, such as the url credential_source's
+// subject token GET below and the JSON-bodied impersonation calls further
+// down this file.
+type httpDoer interface {
+	Do(*http.Request) (*http.Response, error)
+}
+
+// httpDo sends req through p if p also implements httpDoer, so tests can
+// intercept it the same way they intercept PostForm, falling back to
+// http.DefaultClient otherwise.
+func httpDo(p PostFormer, req *http.Request) (*http.Response, error) {
+	if d, ok := p.(httpDoer); ok {
+		return d.Do(req)
+	}
+	return http.DefaultClient.Do(req)
+}
+
+func externalAccountTokenSource(o *options, audience string, data []byte) (oauth2.TokenSource, error) {
+	var key externalAccountKey
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, xerrors.Errorf("failed to parse external account credentials: %w", err)
+	}
+
+	retriever, err := newSubjectTokenRetriever(o, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if key.ServiceAccountImpersonationURL == "" {
+		return nil, errors.New("external_account credentials without service_account_impersonation_url are not supported for IAP")
+	}
+
+	s := &externalAccountTokenSourceImpl{
+		audience:   audience,
+		key:        key,
+		retriever:  retriever,
+		postFormer: o.postFormer,
+	}
+
+	return newReuseTokenSource(s), nil
+}
+
+func newSubjectTokenRetriever(o *options, key externalAccountKey) (subjectTokenRetriever, error) {
+	cs := key.CredentialSource
+
+	switch {
+	case cs.File != "":
+		return &fileSubjectTokenRetriever{file: cs.File, format: cs.Format}, nil
+	case cs.URL != "":
+		return &urlSubjectTokenRetriever{
+			url:        cs.URL,
+			headers:    cs.Headers,
+			format:     cs.Format,
+			postFormer: o.postFormer,
+		}, nil
+	case cs.Executable != nil:
+		return &executableSubjectTokenRetriever{
+			key:    key,
+			source: cs.Executable,
+		}, nil
+	case cs.RegionalCredVerificationURL != "" || cs.EnvironmentID == "aws1":
+		return &awsSubjectTokenRetriever{key: key}, nil
+	default:
+		return nil, errors.New("external_account credential_source must be one of file, url, executable, or aws")
+	}
+}
+
+// fileSubjectTokenRetriever reads the subject token from a local file, as
+// used by the Kubernetes and on-prem OIDC federation flows.
+type fileSubjectTokenRetriever struct {
+	file   string
+	format subjectTokenFormat
+}
+
+func (f *fileSubjectTokenRetriever) subjectToken(audience string) (string, error) {
+	data, err := ioutil.ReadFile(f.file)
+	if err != nil {
+		return "", xerrors.Errorf("failed to read subject token file %s: %w", f.file, err)
+	}
+
+	return parseSubjectToken(data, f.format.Type, f.format.SubjectTokenFieldName)
+}
+
+// urlSubjectTokenRetriever fetches the subject token from an HTTP(S)
+// endpoint, as used by Azure and generic OIDC IdPs.
+type urlSubjectTokenRetriever struct {
+	url        string
+	headers    map[string]string
+	format     subjectTokenFormat
+	postFormer PostFormer
+}
+
+func (u *urlSubjectTokenRetriever) subjectToken(audience string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, u.url, nil)
+	if err != nil {
+		return "", err
+	}
+
+	for k, v := range u.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := httpDo(u.postFormer, req)
+	if err != nil {
+		return "", xerrors.Errorf("failed to fetch subject token from %s: %w", u.url, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", xerrors.Errorf("subject token request to %s failed with status %d: %s", u.url, resp.StatusCode, data)
+	}
+
+	return parseSubjectToken(data, u.format.Type, u.format.SubjectTokenFieldName)
+}
+
+func parseSubjectToken(data []byte, format, fieldName string) (string, error) {
+	if format == "" || format == "text" {
+		return strings.TrimSpace(string(data)), nil
+	}
+
+	if format != "json" {
+		return "", xerrors.Errorf("unsupported subject token format %q", format)
+	}
+
+	if fieldName == "" {
+		return "", errors.New("subject_token_field_name is required for json formatted credential_source")
+	}
+
+	var m map[string]interface{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return "", xerrors.Errorf("failed to parse subject token JSON: %w", err)
+	}
+
+	v, ok := m[fieldName]
+	if !ok {
+		return "", xerrors.Errorf("subject token field %q not found in response", fieldName)
+	}
+
+	s, ok := v.(string)
+	if !ok {
+		return "", xerrors.Errorf("subject token field %q is not a string", fieldName)
+	}
+
+	return s, nil
+}
+
+// impersonatedServiceAccountEmail extracts the target service account's
+// email from a :generateIdToken/:generateAccessToken impersonation URL
+// (".../serviceAccounts/{email}:generate..."), for callers like the
+// executable credential_source that need the bare email rather than the
+// full endpoint.
+func impersonatedServiceAccountEmail(impersonationURL string) string {
+	const marker = "/serviceAccounts/"
+
+	i := strings.Index(impersonationURL, marker)
+	if i < 0 {
+		return ""
+	}
+
+	email := impersonationURL[i+len(marker):]
+	if j := strings.IndexByte(email, ':'); j >= 0 {
+		email = email[:j]
+	}
+
+	return email
+}
+
+// allowExecutablesEnvVar gates the executable credential_source, mirroring
+// the behavior of Google's own client libraries so that running an
+// arbitrary binary is an explicit opt-in.
+const allowExecutablesEnvVar = "GOOGLE_EXTERNAL_ACCOUNT_ALLOW_EXECUTABLES"
+
+// executableSubjectTokenRetriever runs a local binary that prints a JSON
+// response containing the subject token, optionally caching the result in
+// output_file between invocations.
+type executableSubjectTokenRetriever struct {
+	key    externalAccountKey
+	source *externalAccountExecutableSource
+}
+
+type executableResponse struct {
+	Version        int    `json:"version"`
+	Success        bool   `json:"success"`
+	TokenType      string `json:"token_type"`
+	ExpirationTime int64  `json:"expiration_time"`
+	IDToken        string `json:"id_token"`
+	SAMLResponse   string `json:"saml_response"`
+	Code           string `json:"code"`
+	Message        string `json:"message"`
+}
+
+func (e *executableSubjectTokenRetriever) subjectToken(audience string) (string, error) {
+	if e.source.OutputFile != "" {
+		if data, err := ioutil.ReadFile(e.source.OutputFile); err == nil {
+			resp, err := parseExecutableResponse(data)
+			if err == nil && !isExecutableResponseExpired(resp) {
+				return executableResponseToken(resp)
+			}
+		}
+	}
+
+	if os.Getenv(allowExecutablesEnvVar) != "1" {
+		return "", xerrors.Errorf("executable credential_source requires %s=1 to be set", allowExecutablesEnvVar)
+	}
+
+	if e.source.Command == "" {
+		return "", errors.New("executable credential_source is missing command")
+	}
+
+	timeout := time.Duration(e.source.TimeoutMillis) * time.Millisecond
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+
+	fields := strings.Fields(e.source.Command)
+	cmd := exec.Command(fields[0], fields[1:]...)
+	cmd.Env = append(os.Environ(),
+		"GOOGLE_EXTERNAL_ACCOUNT_AUDIENCE="+e.key.Audience,
+		"GOOGLE_EXTERNAL_ACCOUNT_SUBJECT_TOKEN_TYPE="+e.key.SubjectTokenType,
+		"GOOGLE_EXTERNAL_ACCOUNT_TOKEN_URL="+e.key.TokenURL,
+		"GOOGLE_EXTERNAL_ACCOUNT_OUTPUT_FILE="+e.source.OutputFile,
+		"GOOGLE_EXTERNAL_ACCOUNT_IMPERSONATED_EMAIL="+impersonatedServiceAccountEmail(e.key.ServiceAccountImpersonationURL),
+	)
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Run() }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return "", xerrors.Errorf("executable credential_source command failed: %w", err)
+		}
+	case <-time.After(timeout):
+		_ = cmd.Process.Kill()
+		return "", errors.New("executable credential_source command timed out")
+	}
+
+	resp, err := parseExecutableResponse(out.Bytes())
+	if err != nil {
+		return "", err
+	}
+
+	return executableResponseToken(resp)
+}
+
+func parseExecutableResponse(data []byte) (*executableResponse, error) {
+	var resp executableResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, xerrors.Errorf("failed to parse executable response: %w", err)
+	}
+
+	if !resp.Success {
+		return nil, xerrors.Errorf("executable credential_source reported failure: %s: %s", resp.Code, resp.Message)
+	}
+
+	return &resp, nil
+}
+
+func isExecutableResponseExpired(resp *executableResponse) bool {
+	return resp.ExpirationTime != 0 && time.Now().Unix() >= resp.ExpirationTime
+}
+
+func executableResponseToken(resp *executableResponse) (string, error) {
+	if resp.IDToken != "" {
+		return resp.IDToken, nil
+	}
+	if resp.SAMLResponse != "" {
+		return resp.SAMLResponse, nil
+	}
+	return "", errors.New("executable credential_source response did not contain a subject token")
+}
+
+// awsSubjectTokenRetriever produces a subject token by signing a
+// GetCallerIdentity request with SigV4 and URL-encoding the serialized
+// request, per https://google.aip.dev/auth/4117.
+type awsSubjectTokenRetriever struct {
+	key externalAccountKey
+}
+
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Region          string
+}
+
+func (a *awsSubjectTokenRetriever) subjectToken(audience string) (string, error) {
+	creds, err := a.awsCredentials()
+	if err != nil {
+		return "", err
+	}
+
+	req, err := a.signedGetCallerIdentityRequest(creds)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+
+	return url.QueryEscape(string(data)), nil
+}
+
+func (a *awsSubjectTokenRetriever) awsCredentials() (*awsCredentials, error) {
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+
+	if keyID := os.Getenv("AWS_ACCESS_KEY_ID"); keyID != "" {
+		c := &awsCredentials{
+			AccessKeyID:     keyID,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+			Region:          region,
+		}
+		if c.Region == "" {
+			r, err := a.imdsRegion()
+			if err != nil {
+				return nil, err
+			}
+			c.Region = r
+		}
+		return c, nil
+	}
+
+	return a.imdsCredentials()
+}
+
+const imdsBaseURL = "http://169.254.169.254"
+
+// imdsRegion and imdsCredentials use the IMDSv2 flow: fetch a session token
+// via a PUT request, then pass it as a header on subsequent GETs.
+func (a *awsSubjectTokenRetriever) imdsToken() (string, error) {
+	req, err := http.NewRequest(http.MethodPut, imdsBaseURL+"/latest/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "300")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", xerrors.Errorf("failed to fetch IMDSv2 token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+func (a *awsSubjectTokenRetriever) imdsGet(path, token string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, imdsBaseURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token", token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (a *awsSubjectTokenRetriever) imdsRegion() (string, error) {
+	token, err := a.imdsToken()
+	if err != nil {
+		return "", err
+	}
+
+	data, err := a.imdsGet("/latest/meta-data/placement/region", token)
+	if err != nil {
+		return "", xerrors.Errorf("failed to fetch AWS region from IMDS: %w", err)
+	}
+
+	return string(data), nil
+}
+
+func (a *awsSubjectTokenRetriever) imdsCredentials() (*awsCredentials, error) {
+	token, err := a.imdsToken()
+	if err != nil {
+		return nil, err
+	}
+
+	roleData, err := a.imdsGet("/latest/meta-data/iam/security-credentials/", token)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to list AWS IMDS roles: %w", err)
+	}
+
+	role := strings.TrimSpace(string(roleData))
+	if role == "" {
+		return nil, errors.New("no AWS IAM role available from IMDS")
+	}
+
+	credData, err := a.imdsGet("/latest/meta-data/iam/security-credentials/"+role, token)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to fetch AWS IMDS credentials: %w", err)
+	}
+
+	var c struct {
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string `json:"SecretAccessKey"`
+		Token           string `json:"Token"`
+	}
+	if err := json.Unmarshal(credData, &c); err != nil {
+		return nil, xerrors.Errorf("failed to parse AWS IMDS credentials: %w", err)
+	}
+
+	region, err := a.imdsRegion()
+	if err != nil {
+		return nil, err
+	}
+
+	return &awsCredentials{
+		AccessKeyID:     c.AccessKeyID,
+		SecretAccessKey: c.SecretAccessKey,
+		SessionToken:    c.Token,
+		Region:          region,
+	}, nil
+}
+
+// awsRequest is the JSON shape expected by Google's STS endpoint for an AWS
+// subject token: a serialized, signed GetCallerIdentity request.
+type awsRequest struct {
+	URL     string      `json:"url"`
+	Method  string      `json:"method"`
+	Headers []awsHeader `json:"headers"`
+}
+
+type awsHeader struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+func (a *awsSubjectTokenRetriever) signedGetCallerIdentityRequest(creds *awsCredentials) (*awsRequest, error) {
+	host := fmt.Sprintf("sts.%s.amazonaws.com", creds.Region)
+	const query = "Action=GetCallerIdentity&Version=2011-06-15"
+	reqURL := fmt.Sprintf("https://%s/?%s", host, query)
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	dateStamp := now.Format("20060102")
+
+	// The request carries no body; Action and Version travel in the query
+	// string instead, so the signed payload hash is that of an empty body.
+	payloadHash := sha256Hex(nil)
+
+	headers := map[string]string{
+		"host":       host,
+		"x-amz-date": amzDate,
+	}
+	if creds.SessionToken != "" {
+		headers["x-amz-security-token"] = creds.SessionToken
+	}
+	if a.key.Audience != "" {
+		headers["x-goog-cloud-target-resource"] = a.key.Audience
+	}
+
+	signedHeaders, canonicalHeaders := canonicalizeHeaders(headers)
+
+	canonicalRequest := strings.Join([]string{
+		http.MethodPost,
+		"/",
+		query,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/sts/aws4_request", dateStamp, creds.Region)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	signingKey := sigV4Key(creds.SecretAccessKey, dateStamp, creds.Region, "sts")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, []byte(stringToSign)))
+
+	authHeader := fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature,
+	)
+
+	result := &awsRequest{
+		URL:    reqURL,
+		Method: http.MethodPost,
+		Headers: []awsHeader{
+			{Key: "Authorization", Value: authHeader},
+			{Key: "host", Value: host},
+			{Key: "x-amz-date", Value: amzDate},
+		},
+	}
+
+	if creds.SessionToken != "" {
+		result.Headers = append(result.Headers, awsHeader{Key: "x-amz-security-token", Value: creds.SessionToken})
+	}
+	if a.key.Audience != "" {
+		result.Headers = append(result.Headers, awsHeader{Key: "x-goog-cloud-target-resource", Value: a.key.Audience})
+	}
+
+	return result, nil
+}
+
+func canonicalizeHeaders(headers map[string]string) (signedHeaders, canonicalHeaders string) {
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var ch strings.Builder
+	for _, k := range keys {
+		ch.WriteString(k)
+		ch.WriteString(":")
+		ch.WriteString(headers[k])
+		ch.WriteString("\n")
+	}
+
+	return strings.Join(keys, ";"), ch.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func sigV4Key(secret, dateStamp, region, service string) []byte {
+	kDate := hmacSHA256([]byte("AWS4"+secret), []byte(dateStamp))
+	kRegion := hmacSHA256(kDate, []byte(region))
+	kService := hmacSHA256(kRegion, []byte(service))
+	return hmacSHA256(kService, []byte("aws4_request"))
+}
+
+// externalAccountTokenSourceImpl exchanges the third party subject token
+// for a federated Google access token via STS, then impersonates the target
+// service account's :generateIdToken endpoint to obtain the ID token that
+// IAP actually requires.
+type externalAccountTokenSourceImpl struct {
+	audience   string
+	key        externalAccountKey
+	retriever  subjectTokenRetriever
+	postFormer PostFormer
+}
+
+func (e *externalAccountTokenSourceImpl) Token() (*oauth2.Token, error) {
+	subjectToken, err := e.retriever.subjectToken(e.key.Audience)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to retrieve external account subject token: %w", err)
+	}
+
+	accessToken, err := stsExchange(e.postFormer, e.key, subjectToken)
+	if err != nil {
+		return nil, err
+	}
+
+	return impersonateIDToken(e.postFormer, e.key.ServiceAccountImpersonationURL, accessToken.AccessToken, e.audience, nil)
+}
+
+// stsExchange exchanges subjectToken at key.TokenURL for a federated Google
+// access token, per the OAuth 2.0 token exchange flow
+// (urn:ietf:params:oauth:grant-type:token-exchange).
+func stsExchange(p PostFormer, key externalAccountKey, subjectToken string) (*oauth2.Token, error) {
+	v := url.Values{}
+	v.Set("grant_type", "urn:ietf:params:oauth:grant-type:token-exchange")
+	v.Set("audience", key.Audience)
+	v.Set("requested_token_type", "urn:ietf:params:oauth:token-type:access_token")
+	v.Set("subject_token_type", key.SubjectTokenType)
+	v.Set("subject_token", subjectToken)
+	v.Set("scope", "https://www.googleapis.com/auth/cloud-platform")
+
+	resp, err := p.PostForm(key.TokenURL, v)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to exchange subject token at %s: %w", key.TokenURL, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, xerrors.Errorf("token exchange at %s failed with status %d: %s", key.TokenURL, resp.StatusCode, data)
+	}
+
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(data, &tok); err != nil {
+		return nil, xerrors.Errorf("failed to parse STS response: %w", err)
+	}
+
+	expiry := time.Now().Add(time.Hour)
+	if tok.ExpiresIn > 0 {
+		expiry = time.Now().Add(time.Duration(tok.ExpiresIn) * time.Second)
+	}
+
+	return &oauth2.Token{
+		AccessToken: tok.AccessToken,
+		TokenType:   "Bearer",
+		Expiry:      expiry,
+	}, nil
+}
+
+// impersonateIDToken POSTs to a service account's :generateIdToken
+// impersonation endpoint using accessToken as bearer authorization, and
+// returns the resulting ID token as an oauth2.Token.
+func impersonateIDToken(p PostFormer, impersonationURL, accessToken, audience string, delegates []string) (*oauth2.Token, error) {
+	body := struct {
+		Audience     string   `json:"audience"`
+		IncludeEmail bool     `json:"includeEmail"`
+		Delegates    []string `json:"delegates,omitempty"`
+	}{
+		Audience:     audience,
+		IncludeEmail: true,
+		Delegates:    delegates,
+	}
+
+	data, err := json.Marshal(&body)
+	if err != nil {
+		return nil, err
+	}
+
+	genURL := strings.Replace(impersonationURL, ":generateAccessToken", ":generateIdToken", 1)
+
+	req, err := http.NewRequest(http.MethodPost, genURL, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	resp, err := authorizedPostFormer{p, accessToken}.do(req)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to call %s: %w", genURL, err)
+	}
+	defer resp.Body.Close()
+
+	respData, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, xerrors.Errorf("impersonation request to %s failed with status %d: %s", genURL, resp.StatusCode, respData)
+	}
+
+	var tok struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(respData, &tok); err != nil {
+		return nil, xerrors.Errorf("failed to parse impersonation response: %w", err)
+	}
+
+	return &oauth2.Token{
+		AccessToken: tok.Token,
+		TokenType:   "Bearer",
+		Expiry:      time.Now().Add(time.Hour),
+	}, nil
+}
+
+// authorizedPostFormer sends a plain *http.Request POST through httpDo: via
+// the PostFormer's own Do method when it has one (as *http.Client and the
+// test doubles do), otherwise via http.DefaultClient. IAP's PostFormer
+// interface only covers form-encoded bodies, but the impersonation calls
+// use a JSON body with an Authorization header, which the caller sets on
+// the request before calling do.
+type authorizedPostFormer struct {
+	p           PostFormer
+	accessToken string
+}
+
+func (a authorizedPostFormer) do(req *http.Request) (*http.Response, error) {
+	return httpDo(a.p, req)
+}
@@ -0,0 +1,246 @@
+package iap
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// stsPostFormer forwards PostForm calls to an in-memory STS server so that
+// the subject token exchange can be observed without any real network
+// access. It also implements httpDoer so the url credential_source's GET
+// can be observed the same way.
+type stsPostFormer struct {
+	t      *testing.T
+	server *httptest.Server
+
+	didDo bool
+}
+
+func (p *stsPostFormer) PostForm(u string, values url.Values) (*http.Response, error) {
+	require.Equal(p.t, p.server.URL, u)
+	require.Equal(p.t, "urn:ietf:params:oauth:grant-type:token-exchange", values.Get("grant_type"))
+	require.NotEmpty(p.t, values.Get("subject_token"))
+
+	return http.DefaultClient.PostForm(u, values)
+}
+
+func (p *stsPostFormer) Do(req *http.Request) (*http.Response, error) {
+	p.didDo = true
+	return http.DefaultClient.Do(req)
+}
+
+func newExternalAccountServers(t *testing.T) (sts, impersonation *httptest.Server) {
+	sts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(struct {
+			AccessToken string `json:"access_token"`
+		}{
+			AccessToken: "federated-access-token",
+		})
+	}))
+
+	impersonation = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "Bearer federated-access-token", r.Header.Get("Authorization"))
+
+		var body struct {
+			Audience string `json:"audience"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		require.Equal(t, "test@example.com", body.Audience)
+
+		_ = json.NewEncoder(w).Encode(struct {
+			Token string `json:"token"`
+		}{
+			Token: "iap-id-token",
+		})
+	}))
+
+	return sts, impersonation
+}
+
+func externalAccountCredentials(t *testing.T, impersonationURL string, source externalAccountCredSource) []byte {
+	key := externalAccountKey{
+		Type:                           "external_account",
+		Audience:                       "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/pool/providers/provider",
+		SubjectTokenType:               "urn:ietf:params:oauth:token-type:jwt",
+		TokenURL:                       "", // filled in by caller below
+		ServiceAccountImpersonationURL: impersonationURL + "/v1/projects/-/serviceAccounts/test@example.iam.gserviceaccount.com:generateAccessToken",
+		CredentialSource:               source,
+	}
+
+	data, err := json.Marshal(&key)
+	require.NoError(t, err)
+
+	return data
+}
+
+func TestExternalAccountFileSource(t *testing.T) {
+	sts, impersonation := newExternalAccountServers(t)
+	defer sts.Close()
+	defer impersonation.Close()
+
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("subject-token-from-file"), 0600))
+
+	data := externalAccountCredentials(t, impersonation.URL, externalAccountCredSource{
+		File: tokenFile,
+	})
+	data = setTokenURL(t, data, sts.URL)
+
+	i, err := New("test@example.com", WithExternalAccount(data), WithPostFormer(&stsPostFormer{t: t, server: sts}))
+	require.NoError(t, err)
+
+	tok, err := i.Token()
+	require.NoError(t, err)
+	require.Equal(t, "iap-id-token", tok.AccessToken)
+}
+
+func TestExternalAccountURLSource(t *testing.T) {
+	subjectTokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "present", r.Header.Get("X-Test-Header"))
+		_ = json.NewEncoder(w).Encode(struct {
+			Token string `json:"access_token"`
+		}{
+			Token: "subject-token-from-url",
+		})
+	}))
+	defer subjectTokenServer.Close()
+
+	sts, impersonation := newExternalAccountServers(t)
+	defer sts.Close()
+	defer impersonation.Close()
+
+	data := externalAccountCredentials(t, impersonation.URL, externalAccountCredSource{
+		URL:     subjectTokenServer.URL,
+		Headers: map[string]string{"X-Test-Header": "present"},
+		Format: subjectTokenFormat{
+			Type:                  "json",
+			SubjectTokenFieldName: "access_token",
+		},
+	})
+	data = setTokenURL(t, data, sts.URL)
+
+	postFormer := &stsPostFormer{t: t, server: sts}
+	i, err := New("test@example.com", WithExternalAccount(data), WithPostFormer(postFormer))
+	require.NoError(t, err)
+
+	tok, err := i.Token()
+	require.NoError(t, err)
+	require.Equal(t, "iap-id-token", tok.AccessToken)
+	require.True(t, postFormer.didDo, "subject token GET should have been routed through the PostFormer")
+}
+
+func TestExternalAccountExecutableSource(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "get-subject-token.sh")
+	require.NoError(t, ioutil.WriteFile(script, []byte(
+		"#!/bin/sh\necho '{\"version\":1,\"success\":true,\"token_type\":\"urn:ietf:params:oauth:token-type:jwt\",\"id_token\":\"subject-token-from-exec\"}'\n",
+	), 0700))
+
+	require.NoError(t, os.Setenv(allowExecutablesEnvVar, "1"))
+	defer os.Unsetenv(allowExecutablesEnvVar)
+
+	sts, impersonation := newExternalAccountServers(t)
+	defer sts.Close()
+	defer impersonation.Close()
+
+	data := externalAccountCredentials(t, impersonation.URL, externalAccountCredSource{
+		Executable: &externalAccountExecutableSource{
+			Command: script,
+		},
+	})
+	data = setTokenURL(t, data, sts.URL)
+
+	i, err := New("test@example.com", WithExternalAccount(data), WithPostFormer(&stsPostFormer{t: t, server: sts}))
+	require.NoError(t, err)
+
+	tok, err := i.Token()
+	require.NoError(t, err)
+	require.Equal(t, "iap-id-token", tok.AccessToken)
+}
+
+func TestImpersonatedServiceAccountEmail(t *testing.T) {
+	require.Equal(t,
+		"test@example.iam.gserviceaccount.com",
+		impersonatedServiceAccountEmail("https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/test@example.iam.gserviceaccount.com:generateIdToken"),
+	)
+	require.Equal(t,
+		"test@example.iam.gserviceaccount.com",
+		impersonatedServiceAccountEmail("https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/test@example.iam.gserviceaccount.com:generateAccessToken"),
+	)
+	require.Empty(t, impersonatedServiceAccountEmail("not-a-valid-impersonation-url"))
+}
+
+func TestExternalAccountExecutableSourceRequiresOptIn(t *testing.T) {
+	retriever := &executableSubjectTokenRetriever{
+		source: &externalAccountExecutableSource{Command: "/bin/true"},
+	}
+
+	_, err := retriever.subjectToken("test@example.com")
+	require.Error(t, err)
+}
+
+func TestExternalAccountAWSSource(t *testing.T) {
+	require.NoError(t, os.Setenv("AWS_ACCESS_KEY_ID", "AKIAEXAMPLE"))
+	require.NoError(t, os.Setenv("AWS_SECRET_ACCESS_KEY", "secret"))
+	require.NoError(t, os.Setenv("AWS_SESSION_TOKEN", "session"))
+	require.NoError(t, os.Setenv("AWS_REGION", "us-east-1"))
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+	defer os.Unsetenv("AWS_SESSION_TOKEN")
+	defer os.Unsetenv("AWS_REGION")
+
+	retriever := &awsSubjectTokenRetriever{
+		key: externalAccountKey{
+			Audience: "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/pool/providers/provider",
+			CredentialSource: externalAccountCredSource{
+				RegionalCredVerificationURL: "https://sts.{region}.amazonaws.com?Action=GetCallerIdentity&Version=2011-06-15",
+			},
+		},
+	}
+
+	subjectToken, err := retriever.subjectToken("test@example.com")
+	require.NoError(t, err)
+
+	decoded, err := url.QueryUnescape(subjectToken)
+	require.NoError(t, err)
+
+	var req awsRequest
+	require.NoError(t, json.Unmarshal([]byte(decoded), &req))
+	require.Equal(t, "https://sts.us-east-1.amazonaws.com/?Action=GetCallerIdentity&Version=2011-06-15", req.URL)
+
+	var sawAuth, sawSessionToken bool
+	for _, h := range req.Headers {
+		switch h.Key {
+		case "Authorization":
+			sawAuth = true
+			require.Contains(t, h.Value, "AKIAEXAMPLE")
+		case "x-amz-security-token":
+			sawSessionToken = true
+			require.Equal(t, "session", h.Value)
+		}
+	}
+	require.True(t, sawAuth)
+	require.True(t, sawSessionToken)
+}
+
+// setTokenURL re-marshals credentials JSON with token_url set, since the
+// STS server address is only known once httptest.NewServer has started.
+func setTokenURL(t *testing.T, data []byte, tokenURL string) []byte {
+	var key externalAccountKey
+	require.NoError(t, json.Unmarshal(data, &key))
+	key.TokenURL = tokenURL
+
+	out, err := json.Marshal(&key)
+	require.NoError(t, err)
+
+	return out
+}
@@ -4,19 +4,23 @@ package iap
 
 import (
 	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"runtime"
+	"sync"
 	"time"
 
 	"cloud.google.com/go/compute/metadata"
 	"github.com/pkg/errors"
 	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
-	"golang.org/x/oauth2/jwt"
+	"golang.org/x/oauth2/jws"
 	"golang.org/x/xerrors"
 )
 
@@ -38,16 +42,110 @@ type IAP struct {
 	tokenSource oauth2.TokenSource
 }
 
-// Options is passed to New for setting creation options
-type Option func(*IAP) error
+// Option is passed to New for setting creation options
+type Option func(*options) error
 
-// New creates an IAP token source. If filename is empty, then attempt to read
-// from environment varible, then wellknown file, then from compute metadata
-func New(ctx context.Context, audience string, filename string) (*IAP, error) {
-	s, err := getTokenSource(ctx, filename, audience)
+type options struct {
+	ctx             context.Context
+	filename        string
+	credentialsJSON []byte
+	postFormer      PostFormer
+	impersonation   *impersonation
+	tokenCache      TokenCache
+	cacheSkew       time.Duration
+	retry           *retryConfig
+}
+
+// WithContext sets the context whose cancellation ends the waits between
+// attempts under WithRetry. Outgoing requests themselves are not bound to
+// it. If not set, context.Background() is used.
+func WithContext(ctx context.Context) Option {
+	return func(o *options) error {
+		o.ctx = ctx
+		return nil
+	}
+}
+
+// WithFilename sets the path to a credentials file to use instead of
+// consulting the GOOGLE_APPLICATION_CREDENTIALS environment variable or the
+// gcloud well known location.
+func WithFilename(filename string) Option {
+	return func(o *options) error {
+		o.filename = filename
+		return nil
+	}
+}
+
+// WithServiceAccount sets the raw JSON of a service account credentials
+// file to use directly, rather than reading one from disk.
+func WithServiceAccount(data []byte) Option {
+	return func(o *options) error {
+		o.credentialsJSON = data
+		return nil
+	}
+}
+
+// WithExternalAccount sets the raw JSON of a Workload Identity Federation
+// (external_account) credentials file to use directly, rather than reading
+// one from disk. It behaves exactly like WithServiceAccount; the
+// credentials type is sniffed from the JSON's "type" field either way, but
+// this name is clearer at call sites that use external_account credentials.
+func WithExternalAccount(data []byte) Option {
+	return func(o *options) error {
+		o.credentialsJSON = data
+		return nil
+	}
+}
+
+// WithPostFormer sets the PostFormer used to exchange tokens with Google's
+// endpoints. It defaults to http.DefaultClient and mainly exists to allow
+// tests to intercept outgoing requests.
+func WithPostFormer(p PostFormer) Option {
+	return func(o *options) error {
+		o.postFormer = p
+		return nil
+	}
+}
+
+// New creates an IAP token source for audience. Credentials are resolved, in
+// order, from WithServiceAccount/WithExternalAccount, WithFilename, the
+// GOOGLE_APPLICATION_CREDENTIALS environment variable, the gcloud well known
+// file location, and finally the GCE/GKE/Cloud Run metadata server.
+func New(audience string, opts ...Option) (*IAP, error) {
+	o := &options{
+		ctx:        context.Background(),
+		postFormer: http.DefaultClient,
+		cacheSkew:  defaultCacheSkew,
+	}
+
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return nil, err
+		}
+	}
+
+	if o.retry != nil {
+		o.postFormer = &retryingPostFormer{
+			base: o.postFormer,
+			cfg:  o.retry,
+			ctx:  o.ctx,
+		}
+	}
+
+	s, err := getTokenSource(o, audience)
 	if err != nil {
 		return nil, err
 	}
+
+	if o.tokenCache != nil {
+		s = &cachedTokenSource{
+			cache: o.tokenCache,
+			key:   computeCacheKey(o, audience),
+			base:  s,
+			skew:  o.cacheSkew,
+		}
+	}
+
 	return &IAP{
 		audience:    audience,
 		tokenSource: s,
@@ -59,11 +157,109 @@ func (i *IAP) Token() (*oauth2.Token, error) {
 	return i.tokenSource.Token()
 }
 
+// forceRefresh discards any token i's source has cached and mints a new
+// one. It is used by the RoundTripper returned by NewTransport to recover
+// when a backend rejects a token that looked valid locally.
+func (i *IAP) forceRefresh() (*oauth2.Token, error) {
+	return forceRefreshTokenSource(i.tokenSource)
+}
+
+// forceRefresher is implemented by token sources in this package that can
+// bypass their own reuse or caching and mint a genuinely new token.
+type forceRefresher interface {
+	forceRefreshToken() (*oauth2.Token, error)
+}
+
+// forceRefreshTokenSource mints a new token from ts, bypassing any
+// in-process reuse or caching ts performs, if ts supports it.
+func forceRefreshTokenSource(ts oauth2.TokenSource) (*oauth2.Token, error) {
+	if fr, ok := ts.(forceRefresher); ok {
+		return fr.forceRefreshToken()
+	}
+	return ts.Token()
+}
+
+// reuseTokenSource caches the token returned by base until it is no longer
+// oauth2.Token.Valid, the same as oauth2.ReuseTokenSource, but additionally
+// implements forceRefresher so a caller can mint a new token on demand.
+// oauth2.ReuseTokenSource doesn't expose a way to do that, which is why the
+// outermost token source for every credential type in this package is one
+// of these instead.
+type reuseTokenSource struct {
+	mu   sync.Mutex
+	base oauth2.TokenSource
+	tok  *oauth2.Token
+}
+
+func newReuseTokenSource(base oauth2.TokenSource) *reuseTokenSource {
+	return &reuseTokenSource{base: base}
+}
+
+func (r *reuseTokenSource) Token() (*oauth2.Token, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.tok.Valid() {
+		return r.tok, nil
+	}
+
+	return r.refreshLocked()
+}
+
+func (r *reuseTokenSource) forceRefreshToken() (*oauth2.Token, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.refreshLocked()
+}
+
+func (r *reuseTokenSource) refreshLocked() (*oauth2.Token, error) {
+	tok, err := r.base.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	r.tok = tok
+
+	return tok, nil
+}
+
 const (
 	envVar = "GOOGLE_APPLICATION_CREDENTIALS"
 )
 
-func getTokenSource(ctx context.Context, filename string, audience string) (oauth2.TokenSource, error) {
+func getTokenSource(o *options, audience string) (oauth2.TokenSource, error) {
+	if o.impersonation != nil {
+		return impersonatedTokenSource(o, audience)
+	}
+
+	data, err := resolveCredentialsJSON(o)
+	if err != nil {
+		return nil, err
+	}
+
+	if data != nil {
+		return tokenSourceFromJSON(o, audience, data)
+	}
+
+	if metadata.OnGCE() {
+		return newMetadataTokenSource(o, audience), nil
+	}
+
+	return nil, errors.New("unable to determine credentials source")
+}
+
+// resolveCredentialsJSON returns the raw credentials JSON to use, checking
+// WithServiceAccount, WithFilename, the environment variable, and the gcloud
+// well known file location, in that order. A nil slice with no error means
+// no credentials file was found and the caller should fall back to the
+// metadata server.
+func resolveCredentialsJSON(o *options) ([]byte, error) {
+	if o.credentialsJSON != nil {
+		return o.credentialsJSON, nil
+	}
+
+	filename := o.filename
 	if filename == "" {
 		if f := os.Getenv(envVar); f != "" {
 			filename = f
@@ -81,23 +277,40 @@ func getTokenSource(ctx context.Context, filename string, audience string) (oaut
 		}
 	}
 
-	if filename != "" {
-		cfg, err := readCredentialsFile(filename)
-		if err != nil {
-			return nil, err
-		}
-		cfg.UseIDToken = true
-		cfg.PrivateClaims = map[string]interface{}{
-			"target_audience": audience,
-		}
-		return cfg.TokenSource(ctx), nil
+	if filename == "" {
+		return nil, nil
 	}
 
-	if metadata.OnGCE() {
-		return newMetadataTokenSource(audience), nil
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read credentials from %s: %w", filename, err)
 	}
 
-	return nil, errors.New("unable to determine credentials source")
+	return data, nil
+}
+
+// credentialsType is used to sniff the "type" field shared by every
+// supported credentials JSON format before deciding how to fully parse it.
+type credentialsType struct {
+	Type string `json:"type"`
+}
+
+func tokenSourceFromJSON(o *options, audience string, data []byte) (oauth2.TokenSource, error) {
+	var t credentialsType
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, xerrors.Errorf("failed to parse credentials JSON: %w", err)
+	}
+
+	switch t.Type {
+	case "service_account":
+		return serviceAccountTokenSource(o, audience, data)
+	case "external_account":
+		return externalAccountTokenSource(o, audience, data)
+	case "impersonated_service_account":
+		return impersonatedServiceAccountTokenSource(o, audience, data)
+	default:
+		return nil, xerrors.Errorf("unsupported credentials type %q", t.Type)
+	}
 }
 
 func wellKnownFile() string {
@@ -108,32 +321,160 @@ func wellKnownFile() string {
 	return filepath.Join(os.Getenv("HOME"), ".config", "gcloud", f)
 }
 
-func readCredentialsFile(filename string) (*jwt.Config, error) {
-	data, err := ioutil.ReadFile(filename)
+// serviceAccountKey is the subset of a service account credentials file we
+// need to mint an IAP identity token directly, without going through
+// golang.org/x/oauth2/jwt, so that the exchange happens over our
+// PostFormer.
+type serviceAccountKey struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURL     string `json:"token_uri"`
+}
+
+func serviceAccountTokenSource(o *options, audience string, data []byte) (oauth2.TokenSource, error) {
+	var key serviceAccountKey
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, xerrors.Errorf("failed to parse service account credentials: %w", err)
+	}
+
+	privateKey, err := parseRSAPrivateKey(key.PrivateKey)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to parse service account private key: %w", err)
+	}
+
+	tokenURL := key.TokenURL
+	if tokenURL == "" {
+		tokenURL = TokenURI
+	}
+
+	s := &jwtIDTokenSource{
+		audience:   audience,
+		email:      key.ClientEmail,
+		keyID:      key.PrivateKeyID,
+		privateKey: privateKey,
+		tokenURL:   tokenURL,
+		postFormer: o.postFormer,
+	}
+
+	return newReuseTokenSource(s), nil
+}
+
+func parseRSAPrivateKey(data string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("invalid private key: no PEM block found")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
 	if err != nil {
 		return nil, err
 	}
-	c, err := google.JWTConfigFromJSON(data)
+
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("invalid private key: not an RSA key")
+	}
+
+	return key, nil
+}
+
+// jwtIDTokenSource mints a self-signed JWT bearer assertion for a service
+// account and exchanges it at tokenURL for a Google-issued ID token scoped
+// to audience. Unlike golang.org/x/oauth2/jwt, the exchange is performed
+// through postFormer so that callers can observe or mock it.
+type jwtIDTokenSource struct {
+	audience   string
+	email      string
+	keyID      string
+	privateKey *rsa.PrivateKey
+	tokenURL   string
+	postFormer PostFormer
+}
+
+func (j *jwtIDTokenSource) Token() (*oauth2.Token, error) {
+	now := time.Now()
+
+	claims := &jws.ClaimSet{
+		Iss: j.email,
+		Aud: j.tokenURL,
+		Iat: now.Unix(),
+		Exp: now.Add(time.Hour).Unix(),
+		PrivateClaims: map[string]interface{}{
+			"target_audience": j.audience,
+		},
+	}
+
+	header := &jws.Header{
+		Algorithm: "RS256",
+		Typ:       "JWT",
+		KeyID:     j.keyID,
+	}
+
+	assertion, err := jws.Encode(header, claims, j.privateKey)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to sign JWT assertion: %w", err)
+	}
+
+	v := url.Values{}
+	v.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+	v.Set("assertion", assertion)
+
+	resp, err := j.postFormer.PostForm(j.tokenURL, v)
 	if err != nil {
-		return nil, xerrors.Errorf("failed to read service account from %s %w", filename, err)
+		return nil, xerrors.Errorf("failed to exchange JWT assertion: %w", err)
 	}
-	return c, nil
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read token response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, xerrors.Errorf("token exchange failed with status %d: %s", resp.StatusCode, body)
+	}
+
+	var tok struct {
+		IDToken string `json:"id_token"`
+	}
+
+	if err := json.Unmarshal(body, &tok); err != nil {
+		return nil, xerrors.Errorf("failed to parse token response: %w", err)
+	}
+
+	return &oauth2.Token{
+		AccessToken: tok.IDToken,
+		TokenType:   "Bearer",
+		Expiry:      now.Add(time.Hour),
+	}, nil
 }
 
-func newMetadataTokenSource(audience string) oauth2.TokenSource {
+func newMetadataTokenSource(o *options, audience string) oauth2.TokenSource {
 	m := metadataTokenSource{
 		audience: audience,
+		ctx:      o.ctx,
+		retry:    o.retry,
 	}
-	return oauth2.ReuseTokenSource(nil, &m)
+	return newReuseTokenSource(&m)
 }
 
 type metadataTokenSource struct {
 	audience string
+	ctx      context.Context
+	retry    *retryConfig
 }
 
 // see https://cloud.google.com/run/docs/authenticating/service-to-service
 func (m *metadataTokenSource) Token() (*oauth2.Token, error) {
-	data, err := metadata.Get("instance/service-accounts/default/identity?audience=" + m.audience)
+	data, err := retryMetadataGet(m.ctx, m.retry, func() (string, error) {
+		return metadata.Get("instance/service-accounts/default/identity?audience=" + m.audience)
+	})
 	if err != nil {
 		return nil, xerrors.Errorf("failed to get token from metadata service: %w", err)
 	}
@@ -144,3 +485,38 @@ func (m *metadataTokenSource) Token() (*oauth2.Token, error) {
 		Expiry:      time.Now().Add(time.Minute * 30),
 	}, nil
 }
+
+func newMetadataAccessTokenSource(o *options) oauth2.TokenSource {
+	return oauth2.ReuseTokenSource(nil, &metadataAccessTokenSource{ctx: o.ctx, retry: o.retry})
+}
+
+// metadataAccessTokenSource fetches the default service account's OAuth2
+// access token from the metadata server, used as the base principal for
+// WithImpersonation when no explicit credentials are supplied.
+type metadataAccessTokenSource struct {
+	ctx   context.Context
+	retry *retryConfig
+}
+
+func (m *metadataAccessTokenSource) Token() (*oauth2.Token, error) {
+	data, err := retryMetadataGet(m.ctx, m.retry, func() (string, error) {
+		return metadata.Get("instance/service-accounts/default/token")
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("failed to get access token from metadata service: %w", err)
+	}
+
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal([]byte(data), &tok); err != nil {
+		return nil, xerrors.Errorf("failed to parse metadata access token response: %w", err)
+	}
+
+	return &oauth2.Token{
+		AccessToken: tok.AccessToken,
+		TokenType:   "Bearer",
+		Expiry:      time.Now().Add(time.Duration(tok.ExpiresIn) * time.Second),
+	}, nil
+}
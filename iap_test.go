@@ -11,11 +11,36 @@ import (
 	"net/http"
 	"net/url"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/jws"
 )
 
+func TestReuseTokenSourceForceRefreshMintsNewToken(t *testing.T) {
+	base := &counterTokenSource{tok: oauth2.Token{AccessToken: "tok", Expiry: time.Now().Add(time.Hour)}}
+	s := newReuseTokenSource(base)
+
+	tok, err := s.Token()
+	require.NoError(t, err)
+	require.Equal(t, "tok", tok.AccessToken)
+	require.Equal(t, 1, base.calls)
+
+	// A plain Token() call reuses the still-valid cached token.
+	tok, err = s.Token()
+	require.NoError(t, err)
+	require.Equal(t, "tok", tok.AccessToken)
+	require.Equal(t, 1, base.calls)
+
+	// forceRefreshToken mints a new one even though the cached token is
+	// still valid.
+	tok, err = s.forceRefreshToken()
+	require.NoError(t, err)
+	require.Equal(t, "tok", tok.AccessToken)
+	require.Equal(t, 2, base.calls)
+}
+
 func TestTokenSource(t *testing.T) {
 	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
 	require.NoError(t, err)
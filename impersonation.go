@@ -0,0 +1,382 @@
+package iap
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/jws"
+	"golang.org/x/xerrors"
+)
+
+// iamCredentialsBaseURL is the base of the IAM Credentials API used to
+// impersonate a service account by resource name when WithImpersonation is
+// used instead of an impersonated_service_account credentials file.
+const iamCredentialsBaseURL = "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/"
+
+// impersonation holds the configuration set by WithImpersonation.
+type impersonation struct {
+	targetServiceAccount string
+	delegates            []string
+}
+
+// WithImpersonation causes New to mint the IAP identity token by first
+// obtaining an access token from whatever other options are supplied
+// (WithServiceAccount, WithFilename, or the ambient metadata server), then
+// impersonating targetServiceAccount to request the final ID token. This
+// lets a caller chain from any source principal to a target service
+// account that has IAP access without writing an impersonated_service_account
+// credentials file.
+func WithImpersonation(targetServiceAccount string, delegates []string) Option {
+	return func(o *options) error {
+		o.impersonation = &impersonation{
+			targetServiceAccount: targetServiceAccount,
+			delegates:            delegates,
+		}
+		return nil
+	}
+}
+
+func impersonationIDTokenURL(targetServiceAccount string) string {
+	return iamCredentialsBaseURL + targetServiceAccount + ":generateIdToken"
+}
+
+// impersonatedTokenSource builds the IAP identity token source for
+// WithImpersonation: an access token source from the rest of o, wrapped to
+// call the target service account's :generateIdToken endpoint.
+func impersonatedTokenSource(o *options, audience string) (oauth2.TokenSource, error) {
+	base, err := accessTokenSource(o)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &impersonatedIDTokenSource{
+		audience:         audience,
+		impersonationURL: impersonationIDTokenURL(o.impersonation.targetServiceAccount),
+		delegates:        o.impersonation.delegates,
+		base:             base,
+		postFormer:       o.postFormer,
+	}
+
+	return newReuseTokenSource(s), nil
+}
+
+// impersonatedIDTokenSource exchanges an access token from base for an ID
+// token by calling a service account's :generateIdToken endpoint.
+type impersonatedIDTokenSource struct {
+	audience         string
+	impersonationURL string
+	delegates        []string
+	base             oauth2.TokenSource
+	postFormer       PostFormer
+}
+
+func (s *impersonatedIDTokenSource) Token() (*oauth2.Token, error) {
+	base, err := s.base.Token()
+	if err != nil {
+		return nil, xerrors.Errorf("failed to get base access token for impersonation: %w", err)
+	}
+
+	return impersonateIDToken(s.postFormer, s.impersonationURL, base.AccessToken, s.audience, s.delegates)
+}
+
+// accessTokenSource resolves the credentials described by o (in the same
+// order as getTokenSource) to an oauth2.TokenSource that produces plain
+// OAuth2 access tokens, suitable as the base principal for impersonation.
+func accessTokenSource(o *options) (oauth2.TokenSource, error) {
+	data, err := resolveCredentialsJSON(o)
+	if err != nil {
+		return nil, err
+	}
+
+	if data != nil {
+		return accessTokenSourceFromJSON(o, data)
+	}
+
+	if metadata.OnGCE() {
+		return newMetadataAccessTokenSource(o), nil
+	}
+
+	return nil, errors.New("unable to determine credentials source")
+}
+
+func accessTokenSourceFromJSON(o *options, data []byte) (oauth2.TokenSource, error) {
+	var t credentialsType
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, xerrors.Errorf("failed to parse credentials JSON: %w", err)
+	}
+
+	switch t.Type {
+	case "service_account":
+		return serviceAccountAccessTokenSource(o, data)
+	case "external_account":
+		return externalAccountAccessTokenSource(o, data)
+	case "impersonated_service_account":
+		return impersonatedServiceAccountAccessTokenSource(o, data)
+	default:
+		return nil, xerrors.Errorf("unsupported credentials type %q", t.Type)
+	}
+}
+
+func serviceAccountAccessTokenSource(o *options, data []byte) (oauth2.TokenSource, error) {
+	var key serviceAccountKey
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, xerrors.Errorf("failed to parse service account credentials: %w", err)
+	}
+
+	privateKey, err := parseRSAPrivateKey(key.PrivateKey)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to parse service account private key: %w", err)
+	}
+
+	tokenURL := key.TokenURL
+	if tokenURL == "" {
+		tokenURL = TokenURI
+	}
+
+	s := &jwtAccessTokenSource{
+		email:      key.ClientEmail,
+		keyID:      key.PrivateKeyID,
+		privateKey: privateKey,
+		tokenURL:   tokenURL,
+		postFormer: o.postFormer,
+	}
+
+	return oauth2.ReuseTokenSource(nil, s), nil
+}
+
+// jwtAccessTokenSource is the access-token counterpart of jwtIDTokenSource:
+// it signs a JWT bearer assertion scoped to cloud-platform instead of
+// requesting an ID token for a target_audience.
+type jwtAccessTokenSource struct {
+	email      string
+	keyID      string
+	privateKey *rsa.PrivateKey
+	tokenURL   string
+	postFormer PostFormer
+}
+
+func (j *jwtAccessTokenSource) Token() (*oauth2.Token, error) {
+	now := time.Now()
+
+	claims := &jws.ClaimSet{
+		Iss:   j.email,
+		Aud:   j.tokenURL,
+		Scope: "https://www.googleapis.com/auth/cloud-platform",
+		Iat:   now.Unix(),
+		Exp:   now.Add(time.Hour).Unix(),
+	}
+
+	header := &jws.Header{
+		Algorithm: "RS256",
+		Typ:       "JWT",
+		KeyID:     j.keyID,
+	}
+
+	assertion, err := jws.Encode(header, claims, j.privateKey)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to sign JWT assertion: %w", err)
+	}
+
+	v := url.Values{}
+	v.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+	v.Set("assertion", assertion)
+
+	resp, err := j.postFormer.PostForm(j.tokenURL, v)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to exchange JWT assertion: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read token response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, xerrors.Errorf("token exchange failed with status %d: %s", resp.StatusCode, body)
+	}
+
+	var tok struct {
+		AccessToken string `json:"access_token"`
+	}
+
+	if err := json.Unmarshal(body, &tok); err != nil {
+		return nil, xerrors.Errorf("failed to parse token response: %w", err)
+	}
+
+	return &oauth2.Token{
+		AccessToken: tok.AccessToken,
+		TokenType:   "Bearer",
+		Expiry:      now.Add(time.Hour),
+	}, nil
+}
+
+func externalAccountAccessTokenSource(o *options, data []byte) (oauth2.TokenSource, error) {
+	var key externalAccountKey
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, xerrors.Errorf("failed to parse external account credentials: %w", err)
+	}
+
+	retriever, err := newSubjectTokenRetriever(o, key)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &externalAccountAccessTokenSourceImpl{
+		key:        key,
+		retriever:  retriever,
+		postFormer: o.postFormer,
+	}
+
+	return oauth2.ReuseTokenSource(nil, s), nil
+}
+
+type externalAccountAccessTokenSourceImpl struct {
+	key        externalAccountKey
+	retriever  subjectTokenRetriever
+	postFormer PostFormer
+}
+
+func (e *externalAccountAccessTokenSourceImpl) Token() (*oauth2.Token, error) {
+	subjectToken, err := e.retriever.subjectToken(e.key.Audience)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to retrieve external account subject token: %w", err)
+	}
+
+	return stsExchange(e.postFormer, e.key, subjectToken)
+}
+
+// impersonatedServiceAccountKey is an impersonated_service_account
+// credentials file: a pointer at a target service account plus the nested
+// credentials used to authenticate as the source principal.
+type impersonatedServiceAccountKey struct {
+	Type                           string          `json:"type"`
+	ServiceAccountImpersonationURL string          `json:"service_account_impersonation_url"`
+	Delegates                      []string        `json:"delegates"`
+	SourceCredentials              json.RawMessage `json:"source_credentials"`
+}
+
+func impersonatedServiceAccountTokenSource(o *options, audience string, data []byte) (oauth2.TokenSource, error) {
+	var key impersonatedServiceAccountKey
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, xerrors.Errorf("failed to parse impersonated service account credentials: %w", err)
+	}
+
+	base, err := accessTokenSourceFromJSON(o, key.SourceCredentials)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to build source credentials for impersonation: %w", err)
+	}
+
+	s := &impersonatedIDTokenSource{
+		audience:         audience,
+		impersonationURL: key.ServiceAccountImpersonationURL,
+		delegates:        key.Delegates,
+		base:             base,
+		postFormer:       o.postFormer,
+	}
+
+	return newReuseTokenSource(s), nil
+}
+
+func impersonatedServiceAccountAccessTokenSource(o *options, data []byte) (oauth2.TokenSource, error) {
+	var key impersonatedServiceAccountKey
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, xerrors.Errorf("failed to parse impersonated service account credentials: %w", err)
+	}
+
+	base, err := accessTokenSourceFromJSON(o, key.SourceCredentials)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to build source credentials for impersonation: %w", err)
+	}
+
+	accessURL := strings.Replace(key.ServiceAccountImpersonationURL, ":generateIdToken", ":generateAccessToken", 1)
+
+	s := &impersonatedAccessTokenSource{
+		impersonationURL: accessURL,
+		delegates:        key.Delegates,
+		base:             base,
+		postFormer:       o.postFormer,
+	}
+
+	return oauth2.ReuseTokenSource(nil, s), nil
+}
+
+// impersonatedAccessTokenSource calls a service account's
+// :generateAccessToken endpoint, used when an impersonated_service_account
+// is itself nested as the source_credentials of another impersonation.
+type impersonatedAccessTokenSource struct {
+	impersonationURL string
+	delegates        []string
+	base             oauth2.TokenSource
+	postFormer       PostFormer
+}
+
+func (s *impersonatedAccessTokenSource) Token() (*oauth2.Token, error) {
+	base, err := s.base.Token()
+	if err != nil {
+		return nil, xerrors.Errorf("failed to get base access token for impersonation: %w", err)
+	}
+
+	body := struct {
+		Scope     []string `json:"scope"`
+		Delegates []string `json:"delegates,omitempty"`
+	}{
+		Scope:     []string{"https://www.googleapis.com/auth/cloud-platform"},
+		Delegates: s.delegates,
+	}
+
+	data, err := json.Marshal(&body)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.impersonationURL, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+base.AccessToken)
+
+	resp, err := httpDo(s.postFormer, req)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to call %s: %w", s.impersonationURL, err)
+	}
+	defer resp.Body.Close()
+
+	respData, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, xerrors.Errorf("impersonation request to %s failed with status %d: %s", s.impersonationURL, resp.StatusCode, respData)
+	}
+
+	var tok struct {
+		AccessToken string    `json:"accessToken"`
+		ExpireTime  time.Time `json:"expireTime"`
+	}
+	if err := json.Unmarshal(respData, &tok); err != nil {
+		return nil, xerrors.Errorf("failed to parse impersonation response: %w", err)
+	}
+
+	expiry := tok.ExpireTime
+	if expiry.IsZero() {
+		expiry = time.Now().Add(time.Hour)
+	}
+
+	return &oauth2.Token{
+		AccessToken: tok.AccessToken,
+		TokenType:   "Bearer",
+		Expiry:      expiry,
+	}, nil
+}
@@ -0,0 +1,277 @@
+package iap
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+func testServiceAccountJSON(t *testing.T, tokenURL string) []byte {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	enc := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
+	})
+
+	key := serviceAccountKey{
+		Type:        "service_account",
+		ClientEmail: "hello-world@example.com",
+		PrivateKey:  string(enc),
+		TokenURL:    tokenURL,
+	}
+
+	data, err := json.Marshal(&key)
+	require.NoError(t, err)
+
+	return data
+}
+
+// jwtAccessTokenPostFormer answers the JWT-bearer access token exchange
+// performed by jwtAccessTokenSource with a fixed access token.
+type jwtAccessTokenPostFormer struct{}
+
+func (jwtAccessTokenPostFormer) PostForm(u string, values url.Values) (*http.Response, error) {
+	tok := struct {
+		AccessToken string `json:"access_token"`
+	}{
+		AccessToken: "source-access-token",
+	}
+
+	data, err := json.Marshal(&tok)
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Response{
+		StatusCode: 200,
+		Body:       ioutil.NopCloser(bytes.NewBuffer(data)),
+	}, nil
+}
+
+func newImpersonationServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "Bearer source-access-token", r.Header.Get("Authorization"))
+
+		var body struct {
+			Audience string `json:"audience"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		require.Equal(t, "test@example.com", body.Audience)
+
+		_ = json.NewEncoder(w).Encode(struct {
+			Token string `json:"token"`
+		}{
+			Token: "impersonated-id-token",
+		})
+	}))
+}
+
+// TestImpersonatedIDTokenSource exercises the WithImpersonation code path
+// directly, bypassing New's resource-name based URL construction so the
+// request can be pointed at an in-memory server.
+func TestImpersonatedIDTokenSource(t *testing.T) {
+	server := newImpersonationServer(t)
+	defer server.Close()
+
+	s := &impersonatedIDTokenSource{
+		audience:         "test@example.com",
+		impersonationURL: server.URL,
+		base:             oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "source-access-token"}),
+		postFormer:       http.DefaultClient,
+	}
+
+	tok, err := s.Token()
+	require.NoError(t, err)
+	require.Equal(t, "impersonated-id-token", tok.AccessToken)
+}
+
+func TestImpersonatedServiceAccountCredentials(t *testing.T) {
+	server := newImpersonationServer(t)
+	defer server.Close()
+
+	sourceCredentials := testServiceAccountJSON(t, "https://example.com/token")
+
+	key := impersonatedServiceAccountKey{
+		Type:                           "impersonated_service_account",
+		ServiceAccountImpersonationURL: server.URL,
+		SourceCredentials:              sourceCredentials,
+	}
+
+	data, err := json.Marshal(&key)
+	require.NoError(t, err)
+
+	i, err := New("test@example.com", WithServiceAccount(data), WithPostFormer(jwtAccessTokenPostFormer{}))
+	require.NoError(t, err)
+
+	tok, err := i.Token()
+	require.NoError(t, err)
+	require.Equal(t, "impersonated-id-token", tok.AccessToken)
+}
+
+// impersonationEndpointPostFormer answers a service account's JWT-bearer
+// access token exchange via PostForm, and the :generateIdToken call that
+// WithImpersonation issues against the real IAM Credentials URL via Do, so
+// WithImpersonation can be exercised through New without any real network
+// access.
+type impersonationEndpointPostFormer struct {
+	t *testing.T
+}
+
+func (p impersonationEndpointPostFormer) PostForm(u string, values url.Values) (*http.Response, error) {
+	return jwtAccessTokenPostFormer{}.PostForm(u, values)
+}
+
+func (p impersonationEndpointPostFormer) Do(req *http.Request) (*http.Response, error) {
+	require.Equal(p.t, iamCredentialsBaseURL+"target@example.iam.gserviceaccount.com:generateIdToken", req.URL.String())
+	require.Equal(p.t, "Bearer source-access-token", req.Header.Get("Authorization"))
+
+	var body struct {
+		Audience string `json:"audience"`
+	}
+	require.NoError(p.t, json.NewDecoder(req.Body).Decode(&body))
+	require.Equal(p.t, "test@example.com", body.Audience)
+
+	data, err := json.Marshal(struct {
+		Token string `json:"token"`
+	}{
+		Token: "impersonated-id-token",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Response{
+		StatusCode: 200,
+		Body:       ioutil.NopCloser(bytes.NewBuffer(data)),
+	}, nil
+}
+
+// TestWithImpersonation exercises WithImpersonation end-to-end through New:
+// a service account mints a base access token, which is then exchanged for
+// an ID token via the target service account's :generateIdToken endpoint.
+func TestWithImpersonation(t *testing.T) {
+	data := testServiceAccountJSON(t, "https://example.com/token")
+
+	i, err := New("test@example.com",
+		WithServiceAccount(data),
+		WithPostFormer(impersonationEndpointPostFormer{t: t}),
+		WithImpersonation("target@example.iam.gserviceaccount.com", nil),
+	)
+	require.NoError(t, err)
+
+	tok, err := i.Token()
+	require.NoError(t, err)
+	require.Equal(t, "impersonated-id-token", tok.AccessToken)
+}
+
+// newImpersonatedAccessTokenServer answers a :generateAccessToken request
+// the way IAM Credentials does, so a nested impersonated_service_account
+// can be exercised as source_credentials of another impersonation.
+func newImpersonatedAccessTokenServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "Bearer source-access-token", r.Header.Get("Authorization"))
+
+		var body struct {
+			Scope []string `json:"scope"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		require.Equal(t, []string{"https://www.googleapis.com/auth/cloud-platform"}, body.Scope)
+
+		_ = json.NewEncoder(w).Encode(struct {
+			AccessToken string `json:"accessToken"`
+		}{
+			AccessToken: "nested-impersonated-access-token",
+		})
+	}))
+}
+
+// newNestedImpersonationIDTokenServer is newImpersonationServer's
+// counterpart for TestNestedImpersonatedServiceAccountSourceCredentials: the
+// base access token it authenticates is the one minted by the nested
+// impersonated_service_account, not the source service account's own token.
+func newNestedImpersonationIDTokenServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "Bearer nested-impersonated-access-token", r.Header.Get("Authorization"))
+
+		var body struct {
+			Audience string `json:"audience"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		require.Equal(t, "test@example.com", body.Audience)
+
+		_ = json.NewEncoder(w).Encode(struct {
+			Token string `json:"token"`
+		}{
+			Token: "impersonated-id-token",
+		})
+	}))
+}
+
+// TestNestedImpersonatedServiceAccountSourceCredentials exercises an
+// impersonated_service_account used as the source_credentials of another
+// impersonated_service_account, the recursive loader that drives
+// impersonatedServiceAccountAccessTokenSource and
+// impersonatedAccessTokenSource.
+func TestNestedImpersonatedServiceAccountSourceCredentials(t *testing.T) {
+	idTokenServer := newNestedImpersonationIDTokenServer(t)
+	defer idTokenServer.Close()
+
+	accessTokenServer := newImpersonatedAccessTokenServer(t)
+	defer accessTokenServer.Close()
+
+	innerSourceCredentials := testServiceAccountJSON(t, "https://example.com/token")
+
+	innerKey := impersonatedServiceAccountKey{
+		Type:                           "impersonated_service_account",
+		ServiceAccountImpersonationURL: accessTokenServer.URL + "/v1/projects/-/serviceAccounts/nested@example.iam.gserviceaccount.com:generateIdToken",
+		SourceCredentials:              innerSourceCredentials,
+	}
+	innerData, err := json.Marshal(&innerKey)
+	require.NoError(t, err)
+
+	outerKey := impersonatedServiceAccountKey{
+		Type:                           "impersonated_service_account",
+		ServiceAccountImpersonationURL: idTokenServer.URL,
+		SourceCredentials:              innerData,
+	}
+	outerData, err := json.Marshal(&outerKey)
+	require.NoError(t, err)
+
+	postFormer := &jwtThenBearerPostFormer{t: t}
+	i, err := New("test@example.com", WithServiceAccount(outerData), WithPostFormer(postFormer))
+	require.NoError(t, err)
+
+	tok, err := i.Token()
+	require.NoError(t, err)
+	require.Equal(t, "impersonated-id-token", tok.AccessToken)
+}
+
+// jwtThenBearerPostFormer answers the inner source credential's JWT-bearer
+// exchange via PostForm, and the nested impersonated_service_account's
+// :generateAccessToken call via Do (routed through httpDo), mirroring how
+// jwtAccessTokenSource and impersonatedAccessTokenSource each reach the
+// PostFormer.
+type jwtThenBearerPostFormer struct {
+	t *testing.T
+}
+
+func (p *jwtThenBearerPostFormer) PostForm(u string, values url.Values) (*http.Response, error) {
+	return jwtAccessTokenPostFormer{}.PostForm(u, values)
+}
+
+func (p *jwtThenBearerPostFormer) Do(req *http.Request) (*http.Response, error) {
+	return http.DefaultClient.Do(req)
+}
@@ -0,0 +1,241 @@
+package iap
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultRetryBaseDelay = time.Second
+	defaultRetryMaxDelay  = 30 * time.Second
+)
+
+// retryConfig holds the configuration set by WithRetry and WithOnRetry.
+type retryConfig struct {
+	maxAttempts int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+	onRetry     func(attempt int, err error)
+}
+
+// WithRetry causes outbound calls to the metadata server and Google's token
+// endpoints to retry transient failures -- connection errors, 408, 429, and
+// 5xx responses -- with full-jitter exponential backoff (a random delay
+// between zero and baseDelay doubled per attempt, capped at maxDelay),
+// honoring a Retry-After response header when one is present. maxAttempts is the total number of tries, including the first;
+// it also bounds how long a refresh can stall for in a tight retry loop
+// such as per-RPC gRPC credentials.
+func WithRetry(maxAttempts int, baseDelay, maxDelay time.Duration) Option {
+	return func(o *options) error {
+		cfg := o.retry
+		if cfg == nil {
+			cfg = &retryConfig{}
+		}
+		cfg.maxAttempts = maxAttempts
+		cfg.baseDelay = baseDelay
+		cfg.maxDelay = maxDelay
+		o.retry = cfg
+		return nil
+	}
+}
+
+// WithOnRetry sets a hook invoked before every delay performed under
+// WithRetry, with the attempt number (starting at 1) and the error that
+// triggered the retry, for metrics or logging. It has no effect unless
+// WithRetry is also used.
+func WithOnRetry(fn func(attempt int, err error)) Option {
+	return func(o *options) error {
+		cfg := o.retry
+		if cfg == nil {
+			cfg = &retryConfig{}
+		}
+		cfg.onRetry = fn
+		o.retry = cfg
+		return nil
+	}
+}
+
+// retryLoop calls fn until it succeeds, attempts are exhausted, or ctx is
+// done, sleeping with full-jitter exponential backoff between attempts.
+// retryAfter, if non-nil, lets fn's error override the computed backoff
+// with a server-provided delay.
+func retryLoop(ctx context.Context, cfg *retryConfig, fn func() error, retryAfter func(err error) (time.Duration, bool)) error {
+	attempts := cfg.maxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		err = fn()
+		if err == nil {
+			return nil
+		}
+
+		if attempt == attempts-1 {
+			break
+		}
+
+		delay := fullJitterBackoff(cfg, attempt)
+		if retryAfter != nil {
+			if d, ok := retryAfter(err); ok {
+				delay = d
+			}
+		}
+
+		if cfg.onRetry != nil {
+			cfg.onRetry(attempt+1, err)
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return err
+}
+
+// fullJitterBackoff implements the "full jitter" strategy from
+// https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/:
+// a random delay between 0 and min(maxDelay, baseDelay*2^attempt).
+func fullJitterBackoff(cfg *retryConfig, attempt int) time.Duration {
+	base := cfg.baseDelay
+	if base <= 0 {
+		base = defaultRetryBaseDelay
+	}
+
+	max := cfg.maxDelay
+	if max <= 0 {
+		max = defaultRetryMaxDelay
+	}
+
+	d := base * time.Duration(1<<uint(attempt))
+	if d <= 0 || d > max {
+		d = max
+	}
+
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// retryableHTTPError records an HTTP response whose status code warrants a
+// retry, carrying enough of the original response for the caller to act on
+// if retries are exhausted.
+type retryableHTTPError struct {
+	statusCode int
+	retryAfter time.Duration
+	header     http.Header
+	body       []byte
+}
+
+func (e *retryableHTTPError) Error() string {
+	return "received retryable HTTP status " + strconv.Itoa(e.statusCode)
+}
+
+func isRetryableStatus(code int) bool {
+	return code == http.StatusRequestTimeout || code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+}
+
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+
+	return 0
+}
+
+// retryingPostFormer wraps a PostFormer so that connection errors and
+// retryable status codes are retried per cfg before being handed back to
+// the caller.
+type retryingPostFormer struct {
+	base PostFormer
+	cfg  *retryConfig
+	ctx  context.Context
+}
+
+func (p *retryingPostFormer) PostForm(u string, values url.Values) (*http.Response, error) {
+	var resp *http.Response
+
+	err := retryLoop(p.ctx, p.cfg, func() error {
+		r, err := p.base.PostForm(u, values)
+		if err != nil {
+			return err
+		}
+
+		if isRetryableStatus(r.StatusCode) {
+			body, _ := ioutil.ReadAll(r.Body)
+			r.Body.Close()
+			return &retryableHTTPError{
+				statusCode: r.StatusCode,
+				retryAfter: parseRetryAfter(r.Header.Get("Retry-After")),
+				header:     r.Header,
+				body:       body,
+			}
+		}
+
+		resp = r
+		return nil
+	}, func(err error) (time.Duration, bool) {
+		var rerr *retryableHTTPError
+		if errors.As(err, &rerr) && rerr.retryAfter > 0 {
+			return rerr.retryAfter, true
+		}
+		return 0, false
+	})
+
+	if err != nil {
+		var rerr *retryableHTTPError
+		if errors.As(err, &rerr) {
+			return &http.Response{
+				StatusCode: rerr.statusCode,
+				Header:     rerr.header,
+				Body:       ioutil.NopCloser(bytes.NewReader(rerr.body)),
+			}, nil
+		}
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// retryMetadataGet calls get, retrying per cfg if it is non-nil. The
+// compute metadata client doesn't expose the underlying status code, so
+// every error it returns is treated as retryable.
+func retryMetadataGet(ctx context.Context, cfg *retryConfig, get func() (string, error)) (string, error) {
+	if cfg == nil {
+		return get()
+	}
+
+	var data string
+	err := retryLoop(ctx, cfg, func() error {
+		d, err := get()
+		if err != nil {
+			return err
+		}
+		data = d
+		return nil
+	}, nil)
+
+	return data, err
+}
@@ -0,0 +1,109 @@
+package iap
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type flakyPostFormer struct {
+	statuses []int
+	calls    int
+}
+
+func (f *flakyPostFormer) PostForm(u string, values url.Values) (*http.Response, error) {
+	status := f.statuses[f.calls]
+	f.calls++
+
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(bytes.NewBufferString(`{}`)),
+	}, nil
+}
+
+func TestRetryingPostFormerRetriesOnServerError(t *testing.T) {
+	base := &flakyPostFormer{statuses: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK}}
+
+	p := &retryingPostFormer{
+		base: base,
+		cfg:  &retryConfig{maxAttempts: 5, baseDelay: time.Millisecond, maxDelay: 5 * time.Millisecond},
+		ctx:  context.Background(),
+	}
+
+	resp, err := p.PostForm("http://example.com", url.Values{})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, 3, base.calls)
+}
+
+func TestRetryingPostFormerGivesUpAfterMaxAttempts(t *testing.T) {
+	base := &flakyPostFormer{statuses: []int{
+		http.StatusServiceUnavailable,
+		http.StatusServiceUnavailable,
+		http.StatusServiceUnavailable,
+	}}
+
+	p := &retryingPostFormer{
+		base: base,
+		cfg:  &retryConfig{maxAttempts: 3, baseDelay: time.Millisecond, maxDelay: 5 * time.Millisecond},
+		ctx:  context.Background(),
+	}
+
+	resp, err := p.PostForm("http://example.com", url.Values{})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	require.Equal(t, 3, base.calls)
+}
+
+func TestRetryLoopHonorsRetryAfter(t *testing.T) {
+	calls := 0
+	var delays []time.Duration
+
+	retryAfter := http.Header{}
+	retryAfter.Set("Retry-After", "0")
+
+	_ = retryLoop(context.Background(), &retryConfig{maxAttempts: 2, baseDelay: time.Hour, maxDelay: time.Hour}, func() error {
+		calls++
+		if calls == 1 {
+			return &retryableHTTPError{statusCode: http.StatusTooManyRequests, retryAfter: time.Millisecond}
+		}
+		return nil
+	}, func(err error) (time.Duration, bool) {
+		var rerr *retryableHTTPError
+		if errors.As(err, &rerr) {
+			delays = append(delays, rerr.retryAfter)
+			return rerr.retryAfter, true
+		}
+		return 0, false
+	})
+
+	require.Equal(t, 2, calls)
+	require.Equal(t, []time.Duration{time.Millisecond}, delays)
+}
+
+func TestRetryLoopRespectsContextCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	calls := 0
+	err := retryLoop(ctx, &retryConfig{maxAttempts: 5, baseDelay: time.Hour, maxDelay: time.Hour}, func() error {
+		calls++
+		return errors.New("boom")
+	}, nil)
+
+	require.Error(t, err)
+	require.Equal(t, 1, calls)
+}
+
+func TestParseRetryAfterSeconds(t *testing.T) {
+	require.Equal(t, 5*time.Second, parseRetryAfter("5"))
+	require.Equal(t, time.Duration(0), parseRetryAfter(""))
+}
@@ -0,0 +1,93 @@
+package iap
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+// countingTokenSource mints a distinctly-named token on every call, so
+// tests can tell whether a caller reused a cached token or forced a fresh
+// one.
+type countingTokenSource struct {
+	n int32
+}
+
+func (c *countingTokenSource) Token() (*oauth2.Token, error) {
+	n := atomic.AddInt32(&c.n, 1)
+	return &oauth2.Token{
+		AccessToken: fmt.Sprintf("token-%d", n),
+		TokenType:   "Bearer",
+		Expiry:      time.Now().Add(time.Hour),
+	}, nil
+}
+
+func TestTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "Bearer hello-world", r.Header.Get("Authorization"))
+	}))
+	defer server.Close()
+
+	i := &IAP{
+		audience:    "test@example.com",
+		tokenSource: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "hello-world", TokenType: "Bearer"}),
+	}
+
+	client := &http.Client{Transport: NewTransport(nil, i)}
+
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestTransportRefreshesOnUnauthorized(t *testing.T) {
+	var requests int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			require.Equal(t, "Bearer token-1", r.Header.Get("Authorization"))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		require.Equal(t, "Bearer token-2", r.Header.Get("Authorization"))
+	}))
+	defer server.Close()
+
+	i := &IAP{
+		audience:    "test@example.com",
+		tokenSource: newReuseTokenSource(&countingTokenSource{}),
+	}
+
+	client := &http.Client{Transport: NewTransport(nil, i)}
+
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.EqualValues(t, 2, requests)
+}
+
+func TestPerRPCCredentials(t *testing.T) {
+	i := &IAP{
+		audience:    "test@example.com",
+		tokenSource: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "hello-world", TokenType: "Bearer"}),
+	}
+
+	creds := NewPerRPCCredentials(i, true)
+	require.True(t, creds.RequireTransportSecurity())
+
+	md, err := creds.GetRequestMetadata(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "Bearer hello-world", md["authorization"])
+
+	creds = NewPerRPCCredentials(i, false)
+	require.False(t, creds.RequireTransportSecurity())
+}